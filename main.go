@@ -1,140 +1,803 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
+// Action and reason values recorded on every audit log entry.
+const (
+	actionRetain = "retain"
+	actionDelete = "delete"
+	actionDryRun = "dry-run"
+	actionError  = "error"
+
+	reasonPrefixMatch     = "prefix_match"
+	reasonExcludeTag      = "exclude_tag_match"
+	reasonExcludeRegex    = "exclude_regex_match"
+	reasonAgeExceeded     = "age_exceeded"
+	reasonWithinRetention = "within_retention"
+	reasonUntagged        = "untagged"
+	reasonKeptLastN       = "kept_last_n"
+	reasonInUse           = "in_use"
+)
+
+// ecsTaskBatchSize is the maximum number of task ARNs DescribeTasks accepts
+// per call.
+const ecsTaskBatchSize = 100
+
+// batchDeleteLimit is the maximum number of image identifiers ECR accepts
+// in a single BatchDeleteImage call.
+const batchDeleteLimit = 100
+
+// cleanupPolicy bundles the retention rules applied to a repository.
+type cleanupPolicy struct {
+	retention      time.Duration
+	prefixes       []string
+	excludeRegexes []*regexp.Regexp
+	excludeTags    []string
+	keepLast       int
+	deleteUntagged bool
+	dryRun         bool
+
+	// protectedDigests holds "repository@sha256:..." keys for images
+	// currently referenced by a running ECS task or Kubernetes pod. It is
+	// computed once per run and shared across every repository's policy.
+	protectedDigests map[string]bool
+}
+
+// stringSliceFlag implements flag.Value so repeatable flags like
+// -exclude-tag can be passed multiple times on the command line.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// repoPolicyConfig is a single per-repository override loaded from the
+// optional -config file. RepoGlob is matched against repository names with
+// path/filepath.Match. Only non-zero fields override the base policy.
+type repoPolicyConfig struct {
+	RepoGlob         string   `json:"repo_glob" yaml:"repo_glob"`
+	RetentionMinutes int      `json:"retention_minutes,omitempty" yaml:"retention_minutes,omitempty"`
+	KeepLast         *int     `json:"keep_last,omitempty" yaml:"keep_last,omitempty"`
+	Prefixes         []string `json:"prefixes,omitempty" yaml:"prefixes,omitempty"`
+	ExcludeRegexes   []string `json:"exclude_regexes,omitempty" yaml:"exclude_regexes,omitempty"`
+	ExcludeTags      []string `json:"exclude_tags,omitempty" yaml:"exclude_tags,omitempty"`
+	DeleteUntagged   *bool    `json:"delete_untagged,omitempty" yaml:"delete_untagged,omitempty"`
+
+	// compiledExcludeRegexes holds ExcludeRegexes compiled once by
+	// loadConfigFile, so resolvePolicy never recompiles (or panics on bad
+	// config input) on every repository it's called for.
+	compiledExcludeRegexes []*regexp.Regexp
+}
+
+type fileConfig struct {
+	Repositories []repoPolicyConfig `json:"repositories" yaml:"repositories"`
+}
+
+// repoSummary tallies decisions for a single repository.
+type repoSummary struct {
+	actionCounts   map[string]int
+	bytesReclaimed int64
+}
+
+// runSummary tallies decisions across the whole run and is safe for
+// concurrent use by the repository worker pool.
+type runSummary struct {
+	mu             sync.Mutex
+	actionCounts   map[string]int
+	bytesReclaimed int64
+	perRepo        map[string]*repoSummary
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		actionCounts: make(map[string]int),
+		perRepo:      make(map[string]*repoSummary),
+	}
+}
+
+func (s *runSummary) record(repoName, action string, sizeBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.actionCounts[action]++
+	repo, ok := s.perRepo[repoName]
+	if !ok {
+		repo = &repoSummary{actionCounts: make(map[string]int)}
+		s.perRepo[repoName] = repo
+	}
+	repo.actionCounts[action]++
+
+	if action == actionDelete {
+		s.bytesReclaimed += sizeBytes
+		repo.bytesReclaimed += sizeBytes
+	}
+}
+
+// report logs the run summary as a JSON audit record and prints a
+// human-readable per-repository table to stdout.
+func (s *runSummary) report(auditLog *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	auditLog.Info("run_summary",
+		"action_counts", s.actionCounts,
+		"bytes_reclaimed", s.bytesReclaimed,
+	)
+
+	log.Printf("\n📊 Cleanup summary: retained=%d deleted=%d dry-run=%d errors=%d | bytes reclaimed: %d",
+		s.actionCounts[actionRetain], s.actionCounts[actionDelete], s.actionCounts[actionDryRun], s.actionCounts[actionError], s.bytesReclaimed)
+
+	repoNames := make([]string, 0, len(s.perRepo))
+	for repoName := range s.perRepo {
+		repoNames = append(repoNames, repoName)
+	}
+	sort.Strings(repoNames)
+
+	for _, repoName := range repoNames {
+		repo := s.perRepo[repoName]
+		log.Printf("📦 %-40s retained=%-4d deleted=%-4d dry-run=%-4d errors=%-4d bytes reclaimed=%d",
+			repoName, repo.actionCounts[actionRetain], repo.actionCounts[actionDelete],
+			repo.actionCounts[actionDryRun], repo.actionCounts[actionError], repo.bytesReclaimed)
+	}
+}
+
 func main() {
-	// Setup structured logging to both stdout and file
-	logFile, err := os.OpenFile("ecr-cleanup.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	// Human-readable progress goes to stdout; structured audit records go
+	// to a newline-delimited JSON file for downstream ingestion (e.g.
+	// CloudWatch Logs Insights, Athena).
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.LstdFlags)
+
+	auditFile, err := os.OpenFile("ecr-cleanup-audit.jsonl", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		log.Fatalf("❌ Failed to open log file: %v", err)
+		log.Fatalf("❌ Failed to open audit log file: %v", err)
 	}
-	defer logFile.Close()
+	defer auditFile.Close()
+	auditLog := slog.New(slog.NewJSONHandler(auditFile, nil))
 
-	multiWriter := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(multiWriter)
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	region := flag.String("region", os.Getenv("AWS_REGION"), "AWS region (env AWS_REGION)")
+	profile := flag.String("profile", os.Getenv("AWS_PROFILE"), "AWS profile (env AWS_PROFILE)")
+	roleARN := flag.String("role-arn", "", "IAM role ARN to assume, for cross-account cleanup")
+	retention := flag.Int("retention", 5, "retention period in minutes")
+	prefixList := flag.String("prefixes", "", "comma-separated tag prefixes to keep")
+	keepLast := flag.Int("keep-last", 0, "number of most recently pushed images to always keep")
+	concurrency := flag.Int("concurrency", 1, "number of repositories to process concurrently")
+	dryRun := flag.Bool("dry-run", false, "log deletions without performing them")
+	deleteUntagged := flag.Bool("delete-untagged", false, "allow deletion of untagged images")
+	configPath := flag.String("config", "", "path to a YAML/JSON file with per-repository policy overrides")
+	interactive := flag.Bool("interactive", false, "prompt for inputs interactively instead of using flags")
+	protectECS := flag.Bool("protect-ecs", false, "protect images referenced by running ECS tasks from deletion")
+	protectEKS := flag.String("protect-eks", "", "path to a kubeconfig; protect images referenced by running pods in that cluster")
 
-	// Input variables
-	var region string
-	var retention int
-	var prefixList string
-	var dryRunInput string
-	var dryRun bool
+	var excludeTagList, excludeRegexList stringSliceFlag
+	flag.Var(&excludeTagList, "exclude-tag", "tag literal to always keep (repeatable)")
+	flag.Var(&excludeRegexList, "exclude-regex", "regex pattern to always keep (repeatable)")
 
-	// Get user inputs
-	fmt.Print("Enter AWS Region (e.g., us-east-1): ")
-	fmt.Scanln(&region)
+	flag.Parse()
 
-	fmt.Print("Enter retention period in minutes (e.g., 5): ")
-	fmt.Scanln(&retention)
+	if *interactive {
+		runInteractivePrompts(region, retention, prefixList, keepLast, concurrency, dryRun, deleteUntagged, &excludeTagList, &excludeRegexList)
+	}
 
-	fmt.Print("Enter comma-separated tag prefixes to keep (e.g., latest,dev,main): ")
-	fmt.Scanln(&prefixList)
+	if *region == "" {
+		log.Fatalf("❌ No AWS region provided (use -region or AWS_REGION)")
+	}
 
-	fmt.Print("Dry-run mode? (yes/no): ")
-	fmt.Scanln(&dryRunInput)
-	dryRun = strings.ToLower(dryRunInput) == "yes"
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	var excludeRegexes []*regexp.Regexp
+	for _, pattern := range excludeRegexList {
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("❌ Invalid -exclude-regex pattern %q: %v", pattern, err)
+		}
+		excludeRegexes = append(excludeRegexes, re)
+	}
 
-	log.Printf("📌 Region: %s | Retention: %d mins | Prefixes: %s | Dry-run: %v",
-		region, retention, prefixList, dryRun)
+	basePolicy := cleanupPolicy{
+		retention:      time.Duration(*retention) * time.Minute,
+		prefixes:       strings.Split(*prefixList, ","),
+		excludeRegexes: excludeRegexes,
+		excludeTags:    excludeTagList,
+		keepLast:       *keepLast,
+		deleteUntagged: *deleteUntagged,
+		dryRun:         *dryRun,
+	}
 
-	// AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	})
+	var repoConfigs []repoPolicyConfig
+	if *configPath != "" {
+		repoConfigs, err = loadConfigFile(*configPath)
+		if err != nil {
+			log.Fatalf("❌ Failed to load config file %s: %v", *configPath, err)
+		}
+	}
+
+	log.Printf("📌 Region: %s | Retention: %d mins | Prefixes: %s | Keep-last: %d | Concurrency: %d | Delete-untagged: %v | Dry-run: %v",
+		*region, *retention, *prefixList, *keepLast, *concurrency, *deleteUntagged, *dryRun)
+
+	sessOpts := session.Options{
+		Config: aws.Config{Region: aws.String(*region)},
+	}
+	if *profile != "" {
+		sessOpts.Profile = *profile
+	}
+	sess, err := session.NewSessionWithOptions(sessOpts)
 	if err != nil {
 		log.Fatalf("❌ Error creating session: %v", err)
 	}
 
-	// ECR client
+	if *roleARN != "" {
+		creds := stscreds.NewCredentials(sess, *roleARN)
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+		log.Printf("📌 Assuming role: %s", *roleARN)
+	}
+
 	svc := ecr.New(sess)
 
-	// List repositories
-	repos, err := svc.DescribeRepositories(&ecr.DescribeRepositoriesInput{})
+	if *protectECS || *protectEKS != "" {
+		protected, err := collectProtectedDigests(sess, *protectECS, *protectEKS)
+		if err != nil {
+			log.Fatalf("❌ Failed to enumerate in-use images: %v", err)
+		}
+		log.Printf("📌 Found %d in-use image digest(s) to protect", len(protected))
+		basePolicy.protectedDigests = protected
+	}
+
+	// List repositories, paginating across all results
+	var repoNames []string
+	err = svc.DescribeRepositoriesPages(&ecr.DescribeRepositoriesInput{},
+		func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+			for _, repo := range page.Repositories {
+				repoNames = append(repoNames, *repo.RepositoryName)
+			}
+			return true
+		})
 	if err != nil {
 		log.Fatalf("❌ Failed to list repositories: %v", err)
 	}
 
-	if len(repos.Repositories) == 0 {
+	if len(repoNames) == 0 {
 		log.Println("⚠️ No repositories found in the specified region.")
 		return
 	}
 
-	prefixes := strings.Split(prefixList, ",")
+	// Process repositories with a bounded worker pool so large accounts
+	// don't run strictly serially.
+	summary := newRunSummary()
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repoName := range jobs {
+				cleanupRepository(svc, repoName, resolvePolicy(repoName, basePolicy, repoConfigs), auditLog, summary)
+			}
+		}()
+	}
+	for _, repoName := range repoNames {
+		jobs <- repoName
+	}
+	close(jobs)
+	wg.Wait()
 
-	// Process each repo
-	for _, repo := range repos.Repositories {
-		repoName := *repo.RepositoryName
-		log.Printf("\n📦 Repository: %s", repoName)
+	summary.report(auditLog)
+}
 
-		imageOutput, err := svc.DescribeImages(&ecr.DescribeImagesInput{
-			RepositoryName: aws.String(repoName),
-		})
-		if err != nil {
-			log.Printf("⚠️ Error fetching images for %s: %v", repoName, err)
+// runInteractivePrompts preserves the original fmt.Scanln-driven input flow
+// for operators who still want to run the tool by hand; it overwrites the
+// flag-derived values in place, except that exclude regexes and tags entered
+// here are appended to any given as flags.
+func runInteractivePrompts(region *string, retention *int, prefixList *string, keepLast, concurrency *int, dryRun, deleteUntagged *bool, excludeTagList, excludeRegexList *stringSliceFlag) {
+	var dryRunInput, deleteUntaggedInput, excludeTagInput, excludeRegexInput string
+
+	fmt.Print("Enter AWS Region (e.g., us-east-1): ")
+	fmt.Scanln(region)
+
+	fmt.Print("Enter retention period in minutes (e.g., 5): ")
+	fmt.Scanln(retention)
+
+	fmt.Print("Enter comma-separated tag prefixes to keep (e.g., latest,dev,main): ")
+	fmt.Scanln(prefixList)
+
+	fmt.Print("Enter number of most recent images to always keep (e.g., 5): ")
+	fmt.Scanln(keepLast)
+
+	fmt.Print("Enter number of repositories to process concurrently (e.g., 4): ")
+	fmt.Scanln(concurrency)
+
+	fmt.Print("Enter comma-separated exclude-tag regexes (e.g., ^v[0-9]+\\.[0-9]+\\.[0-9]+$,prod-.*): ")
+	fmt.Scanln(&excludeRegexInput)
+	for _, pattern := range strings.Split(excludeRegexInput, ",") {
+		if pattern != "" {
+			*excludeRegexList = append(*excludeRegexList, pattern)
+		}
+	}
+
+	fmt.Print("Enter comma-separated exclude-tag literals (e.g., release,stable): ")
+	fmt.Scanln(&excludeTagInput)
+	for _, tag := range strings.Split(excludeTagInput, ",") {
+		if tag != "" {
+			*excludeTagList = append(*excludeTagList, tag)
+		}
+	}
+
+	fmt.Print("Delete untagged images? (yes/no): ")
+	fmt.Scanln(&deleteUntaggedInput)
+	*deleteUntagged = strings.ToLower(deleteUntaggedInput) == "yes"
+
+	fmt.Print("Dry-run mode? (yes/no): ")
+	fmt.Scanln(&dryRunInput)
+	*dryRun = strings.ToLower(dryRunInput) == "yes"
+}
+
+// loadConfigFile reads per-repository policy overrides from a YAML or JSON
+// file, selected by file extension, and compiles each entry's
+// exclude-regex patterns once up front so resolvePolicy never has to
+// (re)compile them per repository.
+func loadConfigFile(path string) ([]repoPolicyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg fileConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &cfg)
+	default:
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.Repositories {
+		rc := &cfg.Repositories[i]
+		for _, pattern := range rc.ExcludeRegexes {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exclude_regexes entry %q for repo_glob %q: %w", pattern, rc.RepoGlob, err)
+			}
+			rc.compiledExcludeRegexes = append(rc.compiledExcludeRegexes, re)
+		}
+	}
+
+	return cfg.Repositories, nil
+}
+
+// resolvePolicy returns the effective policy for repoName: the base policy
+// with fields overridden by the first repoConfigs entry whose RepoGlob
+// matches the repository name.
+func resolvePolicy(repoName string, base cleanupPolicy, repoConfigs []repoPolicyConfig) cleanupPolicy {
+	policy := base
+	for _, rc := range repoConfigs {
+		matched, err := filepath.Match(rc.RepoGlob, repoName)
+		if err != nil || !matched {
 			continue
 		}
 
-		if len(imageOutput.ImageDetails) == 0 {
-			log.Printf("⚠️ No images found in repository %s", repoName)
+		if rc.RetentionMinutes != 0 {
+			policy.retention = time.Duration(rc.RetentionMinutes) * time.Minute
+		}
+		if rc.KeepLast != nil {
+			policy.keepLast = *rc.KeepLast
+		}
+		if len(rc.Prefixes) > 0 {
+			policy.prefixes = rc.Prefixes
+		}
+		if len(rc.ExcludeTags) > 0 {
+			policy.excludeTags = rc.ExcludeTags
+		}
+		if len(rc.compiledExcludeRegexes) > 0 {
+			policy.excludeRegexes = rc.compiledExcludeRegexes
+		}
+		if rc.DeleteUntagged != nil {
+			policy.deleteUntagged = *rc.DeleteUntagged
+		}
+		break
+	}
+
+	return policy
+}
+
+// collectProtectedDigests builds the set of "repository@sha256:..." image
+// references currently in use by running ECS tasks and/or Kubernetes pods,
+// so that cleanupRepository can retain them regardless of age or tag.
+func collectProtectedDigests(sess *session.Session, protectECS bool, eksKubeconfig string) (map[string]bool, error) {
+	protected := make(map[string]bool)
+
+	if protectECS {
+		ecsProtected, err := collectECSProtectedDigests(ecs.New(sess))
+		if err != nil {
+			return nil, fmt.Errorf("listing ECS in-use images: %w", err)
+		}
+		for digest := range ecsProtected {
+			protected[digest] = true
+		}
+	}
+
+	if eksKubeconfig != "" {
+		eksProtected, err := collectEKSProtectedDigests(eksKubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("listing EKS in-use images: %w", err)
+		}
+		for digest := range eksProtected {
+			protected[digest] = true
+		}
+	}
+
+	return protected, nil
+}
+
+// collectECSProtectedDigests enumerates every cluster's running tasks and
+// returns the set of "repository@sha256:..." references their containers
+// are pinned to.
+func collectECSProtectedDigests(svc ecsiface.ECSAPI) (map[string]bool, error) {
+	protected := make(map[string]bool)
+
+	var clusterARNs []string
+	err := svc.ListClustersPages(&ecs.ListClustersInput{},
+		func(page *ecs.ListClustersOutput, lastPage bool) bool {
+			clusterARNs = append(clusterARNs, aws.StringValueSlice(page.ClusterArns)...)
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cluster := range clusterARNs {
+		var taskARNs []string
+		err := svc.ListTasksPages(&ecs.ListTasksInput{Cluster: aws.String(cluster)},
+			func(page *ecs.ListTasksOutput, lastPage bool) bool {
+				taskARNs = append(taskARNs, aws.StringValueSlice(page.TaskArns)...)
+				return true
+			})
+		if err != nil {
+			log.Printf("⚠️ Error listing tasks for cluster %s: %v", cluster, err)
 			continue
 		}
 
-		for _, image := range imageOutput.ImageDetails {
-			if image.ImagePushedAt == nil {
-				continue
+		for start := 0; start < len(taskARNs); start += ecsTaskBatchSize {
+			end := start + ecsTaskBatchSize
+			if end > len(taskARNs) {
+				end = len(taskARNs)
 			}
 
-			imageAge := int(time.Since(*image.ImagePushedAt).Minutes())
-
-			if len(image.ImageTags) == 0 {
-				log.Printf("🗑️ Untagged image to delete: %s", *image.ImageDigest)
+			out, err := svc.DescribeTasks(&ecs.DescribeTasksInput{
+				Cluster: aws.String(cluster),
+				Tasks:   aws.StringSlice(taskARNs[start:end]),
+			})
+			if err != nil {
+				log.Printf("⚠️ Error describing tasks for cluster %s: %v", cluster, err)
 				continue
 			}
 
-			if imageAge > retention {
-				keep := false
-				for _, tag := range image.ImageTags {
-					for _, prefix := range prefixes {
-						if strings.HasPrefix(*tag, prefix) {
-							keep = true
-						}
+			for _, task := range out.Tasks {
+				for _, container := range task.Containers {
+					if container.ImageDigest == nil || container.Image == nil {
+						continue
+					}
+					repoName := repoNameFromImageRef(*container.Image)
+					if repoName == "" {
+						continue
 					}
+					protected[repoName+"@"+*container.ImageDigest] = true
 				}
+			}
+		}
+	}
 
-				if keep {
-					log.Printf("✅ Retain image (prefix matched): %s", *image.ImageDigest)
-				} else {
-					log.Printf("🗑️ Old image to delete: %s (Age: %d minutes)", *image.ImageDigest, imageAge)
-
-					if !dryRun {
-						_, err := svc.BatchDeleteImage(&ecr.BatchDeleteImageInput{
-							RepositoryName: aws.String(repoName),
-							ImageIds: []*ecr.ImageIdentifier{
-								{ImageDigest: image.ImageDigest},
-							},
-						})
-						if err != nil {
-							log.Printf("❌ Error deleting image %s: %v", *image.ImageDigest, err)
-						} else {
-							log.Printf("✅ Image deleted: %s", *image.ImageDigest)
-						}
-					} else {
-						log.Printf("ℹ️ Dry-run mode: Skipped deletion of image %s", *image.ImageDigest)
-					}
+	return protected, nil
+}
+
+// collectEKSProtectedDigests lists every pod across all namespaces in the
+// cluster described by kubeconfigPath and returns the set of
+// "repository@sha256:..." references their containers are running.
+func collectEKSProtectedDigests(kubeconfigPath string) (map[string]bool, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	protected := make(map[string]bool)
+	for _, pod := range pods.Items {
+		for _, cs := range pod.Status.ContainerStatuses {
+			repoName, digest := repoAndDigestFromImageID(cs.ImageID)
+			if repoName == "" || digest == "" {
+				continue
+			}
+			protected[repoName+"@"+digest] = true
+		}
+	}
+
+	return protected, nil
+}
+
+// repoNameFromImageRef extracts the ECR repository name from an image
+// reference such as "<account>.dkr.ecr.<region>.amazonaws.com/my-repo:tag".
+func repoNameFromImageRef(ref string) string {
+	ref = strings.TrimPrefix(ref, "docker-pullable://")
+	slash := strings.Index(ref, "/")
+	if slash == -1 {
+		return ""
+	}
+	path := ref[slash+1:]
+	if at := strings.Index(path, "@"); at != -1 {
+		path = path[:at]
+	}
+	if colon := strings.LastIndex(path, ":"); colon != -1 {
+		path = path[:colon]
+	}
+	return path
+}
+
+// repoAndDigestFromImageID splits a Kubernetes container status imageID
+// such as "docker-pullable://<account>.dkr.ecr.<region>.amazonaws.com/my-repo@sha256:..."
+// into its repository name and digest.
+func repoAndDigestFromImageID(imageID string) (repoName, digest string) {
+	ref := strings.TrimPrefix(imageID, "docker-pullable://")
+	at := strings.Index(ref, "@")
+	if at == -1 {
+		return "", ""
+	}
+	digest = ref[at+1:]
+	path := ref[:at]
+	if slash := strings.Index(path, "/"); slash != -1 {
+		path = path[slash+1:]
+	}
+	return path, digest
+}
+
+// tagExcluded reports whether tag should be protected from deletion because
+// it matches a keep prefix, an exclude regex, or an exclude-tag literal. It
+// also returns the matching reason for the audit log.
+func tagExcluded(tag string, prefixes []string, excludeRegexes []*regexp.Regexp, excludeTags []string) (bool, string) {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(tag, prefix) {
+			return true, reasonPrefixMatch
+		}
+	}
+	for _, excludeTag := range excludeTags {
+		if tag == excludeTag {
+			return true, reasonExcludeTag
+		}
+	}
+	for _, re := range excludeRegexes {
+		if re.MatchString(tag) {
+			return true, reasonExcludeRegex
+		}
+	}
+	return false, ""
+}
+
+// cleanupRepository applies policy to a single repository: it paginates
+// through every image, determines which are deletable, and issues
+// BatchDeleteImage calls in chunks of up to batchDeleteLimit images. Every
+// image with a known push time gets an audit record (JSON to auditLog,
+// human-readable to stdout) and a tally in summary; images without one are
+// skipped.
+func cleanupRepository(svc ecriface.ECRAPI, repoName string, policy cleanupPolicy, auditLog *slog.Logger, summary *runSummary) {
+	log.Printf("\n📦 Repository: %s", repoName)
+
+	var images []*ecr.ImageDetail
+	err := svc.DescribeImagesPages(&ecr.DescribeImagesInput{RepositoryName: aws.String(repoName)},
+		func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+			images = append(images, page.ImageDetails...)
+			return true
+		})
+	if err != nil {
+		log.Printf("⚠️ Error fetching images for %s: %v", repoName, err)
+		return
+	}
+
+	if len(images) == 0 {
+		log.Printf("⚠️ No images found in repository %s", repoName)
+		return
+	}
+
+	decisions := evaluateImages(images, policy, repoName)
+	byDigest := make(map[string]*imageDecision, len(decisions))
+	var toDelete []*ecr.ImageIdentifier
+	for i := range decisions {
+		d := &decisions[i]
+		byDigest[d.Digest] = d
+		if d.Action == actionDelete {
+			if policy.dryRun {
+				d.Action = actionDryRun
+			} else {
+				toDelete = append(toDelete, &ecr.ImageIdentifier{ImageDigest: aws.String(d.Digest)})
+			}
+		}
+	}
+
+	for start := 0; start < len(toDelete); start += batchDeleteLimit {
+		end := start + batchDeleteLimit
+		if end > len(toDelete) {
+			end = len(toDelete)
+		}
+		chunk := toDelete[start:end]
+
+		out, err := svc.BatchDeleteImage(&ecr.BatchDeleteImageInput{
+			RepositoryName: aws.String(repoName),
+			ImageIds:       chunk,
+		})
+		if err != nil {
+			log.Printf("❌ Error deleting batch of %d images in %s: %v", len(chunk), repoName, err)
+			for _, id := range chunk {
+				d := byDigest[*id.ImageDigest]
+				d.Action, d.Reason = actionError, err.Error()
+			}
+			continue
+		}
+		for _, failure := range out.Failures {
+			d := byDigest[aws.StringValue(failure.ImageId.ImageDigest)]
+			d.Action = actionError
+			d.Reason = fmt.Sprintf("%s: %s", aws.StringValue(failure.FailureCode), aws.StringValue(failure.FailureReason))
+		}
+	}
+
+	for _, d := range decisions {
+		logDecision(auditLog, repoName, d)
+		summary.record(repoName, d.Action, d.SizeBytes)
+	}
+}
+
+// logDecision writes a structured JSON audit record and a matching
+// human-readable line for a single image's retention decision.
+func logDecision(auditLog *slog.Logger, repoName string, d imageDecision) {
+	auditLog.Info("image_decision",
+		"repository", repoName,
+		"image_digest", d.Digest,
+		"tags", d.Tags,
+		"pushed_at", d.PushedAt,
+		"age_minutes", d.AgeMinutes,
+		"action", d.Action,
+		"reason", d.Reason,
+	)
+
+	switch d.Action {
+	case actionDelete:
+		log.Printf("🗑️ Deleted image %s in %s (age: %dm, reason: %s)", d.Digest, repoName, d.AgeMinutes, d.Reason)
+	case actionDryRun:
+		log.Printf("ℹ️ Dry-run mode: would delete image %s in %s (age: %dm, reason: %s)", d.Digest, repoName, d.AgeMinutes, d.Reason)
+	case actionError:
+		log.Printf("❌ Failed to delete image %s in %s (reason: %s)", d.Digest, repoName, d.Reason)
+	default:
+		log.Printf("✅ Retain image %s in %s (reason: %s)", d.Digest, repoName, d.Reason)
+	}
+}
+
+// imageDecision is the audit record for a single image: what the policy
+// decided to do with it, and why.
+type imageDecision struct {
+	Digest     string
+	Tags       []string
+	PushedAt   time.Time
+	AgeMinutes int
+	SizeBytes  int64
+	Action     string
+	Reason     string
+}
+
+// evaluateImages applies policy to a single repository's images and
+// returns one decision per image that has a known push time. Images in
+// policy.protectedDigests (currently referenced by a running ECS task or
+// Kubernetes pod) are always retained. Otherwise images are retained if
+// they fall within the retention window, are among the keepLast most
+// recently pushed images in the repository, or (for tagged images) carry a
+// tag matching a keep prefix, an exclude regex, or an exclude-tag literal.
+// Untagged images are only marked deletable when policy.deleteUntagged is
+// set. Sorting by push time means keepLast always protects the newest
+// images even when they would otherwise be deletable by age or as
+// untagged.
+func evaluateImages(images []*ecr.ImageDetail, policy cleanupPolicy, repoName string) []imageDecision {
+	sorted := make([]*ecr.ImageDetail, len(images))
+	copy(sorted, images)
+	sort.Slice(sorted, func(i, j int) bool {
+		var ti, tj time.Time
+		if sorted[i].ImagePushedAt != nil {
+			ti = *sorted[i].ImagePushedAt
+		}
+		if sorted[j].ImagePushedAt != nil {
+			tj = *sorted[j].ImagePushedAt
+		}
+		return ti.After(tj)
+	})
+
+	var decisions []imageDecision
+	for i, image := range sorted {
+		if image.ImagePushedAt == nil {
+			continue
+		}
+
+		tags := make([]string, len(image.ImageTags))
+		for t, tag := range image.ImageTags {
+			tags[t] = *tag
+		}
+
+		d := imageDecision{
+			Digest:     *image.ImageDigest,
+			Tags:       tags,
+			PushedAt:   *image.ImagePushedAt,
+			AgeMinutes: int(time.Since(*image.ImagePushedAt).Minutes()),
+			SizeBytes:  aws.Int64Value(image.ImageSizeInBytes),
+		}
+
+		switch {
+		case policy.protectedDigests[repoName+"@"+d.Digest]:
+			d.Action, d.Reason = actionRetain, reasonInUse
+		case i < policy.keepLast:
+			d.Action, d.Reason = actionRetain, reasonKeptLastN
+		case time.Since(*image.ImagePushedAt) <= policy.retention:
+			// Applies to untagged images too: an image that's still mid
+			// multi-stage build shouldn't be deleted just because it has
+			// no tags yet.
+			d.Action, d.Reason = actionRetain, reasonWithinRetention
+		case len(tags) == 0:
+			if policy.deleteUntagged {
+				d.Action, d.Reason = actionDelete, reasonUntagged
+			} else {
+				d.Action, d.Reason = actionRetain, reasonUntagged
+			}
+		default:
+			d.Action, d.Reason = actionDelete, reasonAgeExceeded
+			for _, tag := range tags {
+				if excluded, reason := tagExcluded(tag, policy.prefixes, policy.excludeRegexes, policy.excludeTags); excluded {
+					d.Action, d.Reason = actionRetain, reason
+					break
 				}
 			}
 		}
+
+		decisions = append(decisions, d)
 	}
+
+	return decisions
 }
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// discardAuditLog returns a *slog.Logger that throws away everything it's
+// given, for tests that only care about cleanupRepository's side effects on
+// the ECR API and runSummary.
+func discardAuditLog() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(io.Discard, nil))
+}
+
+// capturingAuditLog returns a *slog.Logger backed by buf, so a test can
+// inspect the JSON audit records cleanupRepository wrote.
+func capturingAuditLog(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(buf, nil))
+}
+
+func mustCompile(t *testing.T, pattern string) *regexp.Regexp {
+	t.Helper()
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		t.Fatalf("failed to compile test pattern %q: %v", pattern, err)
+	}
+	return re
+}
+
+func TestTagExcluded(t *testing.T) {
+	prefixes := []string{"latest", "main"}
+	excludeRegexes := []*regexp.Regexp{mustCompile(t, `^v\d+\.\d+\.\d+$`)}
+	excludeTags := []string{"release"}
+
+	tests := []struct {
+		name       string
+		tag        string
+		wantExcl   bool
+		wantReason string
+	}{
+		{"prefix match", "latest-2026", true, reasonPrefixMatch},
+		{"exclude tag literal", "release", true, reasonExcludeTag},
+		{"exclude regex match", "v1.2.3", true, reasonExcludeRegex},
+		{"no match", "feature-branch", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotExcl, gotReason := tagExcluded(tt.tag, prefixes, excludeRegexes, excludeTags)
+			if gotExcl != tt.wantExcl || gotReason != tt.wantReason {
+				t.Errorf("tagExcluded(%q) = (%v, %q), want (%v, %q)", tt.tag, gotExcl, gotReason, tt.wantExcl, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestEvaluateImages(t *testing.T) {
+	now := time.Now()
+
+	image := func(digest string, pushedAgo time.Duration, tags ...string) *ecr.ImageDetail {
+		pushedAt := now.Add(-pushedAgo)
+		var imageTags []*string
+		for _, tag := range tags {
+			imageTags = append(imageTags, aws.String(tag))
+		}
+		return &ecr.ImageDetail{
+			ImageDigest:      aws.String(digest),
+			ImagePushedAt:    &pushedAt,
+			ImageTags:        imageTags,
+			ImageSizeInBytes: aws.Int64(100),
+		}
+	}
+
+	tests := []struct {
+		name     string
+		images   []*ecr.ImageDetail
+		policy   cleanupPolicy
+		repoName string
+		want     map[string]string // digest -> expected action
+	}{
+		{
+			name: "within retention is retained",
+			images: []*ecr.ImageDetail{
+				image("sha256:new", time.Minute, "v1"),
+			},
+			policy: cleanupPolicy{retention: time.Hour},
+			want:   map[string]string{"sha256:new": actionRetain},
+		},
+		{
+			name: "aged out and untagged by default is retained",
+			images: []*ecr.ImageDetail{
+				image("sha256:old", 2*time.Hour),
+			},
+			policy: cleanupPolicy{retention: time.Hour},
+			want:   map[string]string{"sha256:old": actionRetain},
+		},
+		{
+			name: "aged out and untagged is deleted when delete-untagged set",
+			images: []*ecr.ImageDetail{
+				image("sha256:old", 2*time.Hour),
+			},
+			policy: cleanupPolicy{retention: time.Hour, deleteUntagged: true},
+			want:   map[string]string{"sha256:old": actionDelete},
+		},
+		{
+			name: "freshly pushed untagged image is retained even with delete-untagged set",
+			images: []*ecr.ImageDetail{
+				image("sha256:fresh", time.Minute),
+			},
+			policy: cleanupPolicy{retention: time.Hour, deleteUntagged: true},
+			want:   map[string]string{"sha256:fresh": actionRetain},
+		},
+		{
+			name: "aged out and tagged without exclusions is deleted",
+			images: []*ecr.ImageDetail{
+				image("sha256:old", 2*time.Hour, "feature-branch"),
+			},
+			policy: cleanupPolicy{retention: time.Hour},
+			want:   map[string]string{"sha256:old": actionDelete},
+		},
+		{
+			name: "keep-last protects the most recently pushed images regardless of age",
+			images: []*ecr.ImageDetail{
+				image("sha256:newest", 3*time.Hour, "build-3"),
+				image("sha256:older", 4*time.Hour, "build-2"),
+				image("sha256:oldest", 5*time.Hour, "build-1"),
+			},
+			policy: cleanupPolicy{retention: time.Hour, keepLast: 2},
+			want: map[string]string{
+				"sha256:newest": actionRetain,
+				"sha256:older":  actionRetain,
+				"sha256:oldest": actionDelete,
+			},
+		},
+		{
+			name: "prefix match keeps an aged out image",
+			images: []*ecr.ImageDetail{
+				image("sha256:old", 2*time.Hour, "latest"),
+			},
+			policy: cleanupPolicy{retention: time.Hour, prefixes: []string{"latest"}},
+			want:   map[string]string{"sha256:old": actionRetain},
+		},
+		{
+			name: "in-use digest is always retained",
+			images: []*ecr.ImageDetail{
+				image("sha256:inuse", 2*time.Hour, "feature-branch"),
+			},
+			policy: cleanupPolicy{
+				retention:        time.Hour,
+				protectedDigests: map[string]bool{"my-repo@sha256:inuse": true},
+			},
+			repoName: "my-repo",
+			want:     map[string]string{"sha256:inuse": actionRetain},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoName := tt.repoName
+			if repoName == "" {
+				repoName = "my-repo"
+			}
+			decisions := evaluateImages(tt.images, tt.policy, repoName)
+			if len(decisions) != len(tt.want) {
+				t.Fatalf("got %d decisions, want %d", len(decisions), len(tt.want))
+			}
+			for _, d := range decisions {
+				want, ok := tt.want[d.Digest]
+				if !ok {
+					t.Fatalf("unexpected decision for digest %s", d.Digest)
+				}
+				if d.Action != want {
+					t.Errorf("digest %s: action = %s, want %s (reason: %s)", d.Digest, d.Action, want, d.Reason)
+				}
+			}
+		})
+	}
+}
+
+func TestResolvePolicy(t *testing.T) {
+	base := cleanupPolicy{retention: time.Hour, keepLast: 0, deleteUntagged: false}
+
+	keepLastOverride := 10
+	deleteUntaggedOverride := true
+	repoConfigs := []repoPolicyConfig{
+		{
+			RepoGlob:         "staging-*",
+			RetentionMinutes: 30,
+			KeepLast:         &keepLastOverride,
+		},
+		{
+			RepoGlob:       "prod-*",
+			DeleteUntagged: &deleteUntaggedOverride,
+		},
+	}
+
+	tests := []struct {
+		name     string
+		repoName string
+		want     cleanupPolicy
+	}{
+		{
+			name:     "matches first glob and overrides retention and keep-last",
+			repoName: "staging-api",
+			want:     cleanupPolicy{retention: 30 * time.Minute, keepLast: 10, deleteUntagged: false},
+		},
+		{
+			name:     "matches second glob and overrides delete-untagged only",
+			repoName: "prod-api",
+			want:     cleanupPolicy{retention: time.Hour, keepLast: 0, deleteUntagged: true},
+		},
+		{
+			name:     "no glob matches falls back to base policy",
+			repoName: "sandbox-api",
+			want:     base,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolvePolicy(tt.repoName, base, repoConfigs)
+			if got.retention != tt.want.retention || got.keepLast != tt.want.keepLast || got.deleteUntagged != tt.want.deleteUntagged {
+				t.Errorf("resolvePolicy(%q) = %+v, want %+v", tt.repoName, got, tt.want)
+			}
+		})
+	}
+}
+
+// mockECR implements ecriface.ECRAPI, providing only the methods
+// cleanupRepository actually calls; the embedded interface satisfies the
+// rest so this stays in sync with the SDK without reimplementing it.
+type mockECR struct {
+	ecriface.ECRAPI
+	images         []*ecr.ImageDetail
+	deletedDigests []string
+	describeErr    error
+	batchDeleteErr error
+	// batchFailures maps an image digest to the per-image failure ECR
+	// should report for it in BatchDeleteImageOutput.Failures, instead of
+	// deleting it.
+	batchFailures map[string]*ecr.ImageFailure
+}
+
+func (m *mockECR) DescribeImagesPages(input *ecr.DescribeImagesInput, fn func(*ecr.DescribeImagesOutput, bool) bool) error {
+	if m.describeErr != nil {
+		return m.describeErr
+	}
+	fn(&ecr.DescribeImagesOutput{ImageDetails: m.images}, true)
+	return nil
+}
+
+func (m *mockECR) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*ecr.BatchDeleteImageOutput, error) {
+	if m.batchDeleteErr != nil {
+		return nil, m.batchDeleteErr
+	}
+	out := &ecr.BatchDeleteImageOutput{}
+	for _, id := range input.ImageIds {
+		if failure, ok := m.batchFailures[*id.ImageDigest]; ok {
+			out.Failures = append(out.Failures, failure)
+			continue
+		}
+		m.deletedDigests = append(m.deletedDigests, *id.ImageDigest)
+	}
+	return out, nil
+}
+
+func TestCleanupRepository(t *testing.T) {
+	now := time.Now()
+	pushedOld := now.Add(-2 * time.Hour)
+	pushedNew := now.Add(-time.Minute)
+
+	mock := &mockECR{
+		images: []*ecr.ImageDetail{
+			{
+				ImageDigest:      aws.String("sha256:old"),
+				ImagePushedAt:    &pushedOld,
+				ImageTags:        []*string{aws.String("feature-branch")},
+				ImageSizeInBytes: aws.Int64(100),
+			},
+			{
+				ImageDigest:      aws.String("sha256:new"),
+				ImagePushedAt:    &pushedNew,
+				ImageTags:        []*string{aws.String("main")},
+				ImageSizeInBytes: aws.Int64(200),
+			},
+		},
+	}
+
+	policy := cleanupPolicy{retention: time.Hour}
+	summary := newRunSummary()
+	cleanupRepository(mock, "my-repo", policy, discardAuditLog(), summary)
+
+	if len(mock.deletedDigests) != 1 || mock.deletedDigests[0] != "sha256:old" {
+		t.Errorf("deletedDigests = %v, want [sha256:old]", mock.deletedDigests)
+	}
+
+	repo := summary.perRepo["my-repo"]
+	if repo == nil {
+		t.Fatal("expected a repo summary for my-repo")
+	}
+	if repo.actionCounts[actionDelete] != 1 || repo.actionCounts[actionRetain] != 1 {
+		t.Errorf("actionCounts = %+v, want delete=1 retain=1", repo.actionCounts)
+	}
+}
+
+func TestCleanupRepositoryRecordsBatchDeleteFailures(t *testing.T) {
+	pushedOld := time.Now().Add(-2 * time.Hour)
+
+	t.Run("per-image failure reports ECR's failure code and reason", func(t *testing.T) {
+		mock := &mockECR{
+			images: []*ecr.ImageDetail{
+				{
+					ImageDigest:      aws.String("sha256:old"),
+					ImagePushedAt:    &pushedOld,
+					ImageTags:        []*string{aws.String("feature-branch")},
+					ImageSizeInBytes: aws.Int64(100),
+				},
+			},
+			batchFailures: map[string]*ecr.ImageFailure{
+				"sha256:old": {
+					ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String("sha256:old")},
+					FailureCode:   aws.String("ImageReferencedByManifestList"),
+					FailureReason: aws.String("Image is referenced by a manifest list in another repository"),
+				},
+			},
+		}
+
+		var buf bytes.Buffer
+		summary := newRunSummary()
+		cleanupRepository(mock, "my-repo", cleanupPolicy{retention: time.Hour}, capturingAuditLog(&buf), summary)
+
+		if len(mock.deletedDigests) != 0 {
+			t.Errorf("deletedDigests = %v, want none", mock.deletedDigests)
+		}
+		repo := summary.perRepo["my-repo"]
+		if repo == nil || repo.actionCounts[actionError] != 1 {
+			t.Fatalf("actionCounts = %+v, want error=1", repo)
+		}
+		if got := buf.String(); !strings.Contains(got, "ImageReferencedByManifestList") || !strings.Contains(got, "Image is referenced by a manifest list") {
+			t.Errorf("audit log = %s, want it to contain the ECR failure code and reason", got)
+		}
+	})
+
+	t.Run("whole-batch error carries the error text as the reason", func(t *testing.T) {
+		mock := &mockECR{
+			images: []*ecr.ImageDetail{
+				{
+					ImageDigest:      aws.String("sha256:old"),
+					ImagePushedAt:    &pushedOld,
+					ImageTags:        []*string{aws.String("feature-branch")},
+					ImageSizeInBytes: aws.Int64(100),
+				},
+			},
+			batchDeleteErr: fmt.Errorf("RepositoryNotFoundException: repository my-repo does not exist"),
+		}
+
+		var buf bytes.Buffer
+		summary := newRunSummary()
+		cleanupRepository(mock, "my-repo", cleanupPolicy{retention: time.Hour}, capturingAuditLog(&buf), summary)
+
+		repo := summary.perRepo["my-repo"]
+		if repo == nil || repo.actionCounts[actionError] != 1 {
+			t.Fatalf("actionCounts = %+v, want error=1", repo)
+		}
+		if got := buf.String(); !strings.Contains(got, "RepositoryNotFoundException") {
+			t.Errorf("audit log = %s, want it to contain the batch delete error text", got)
+		}
+	})
+}
+
+// mockECS implements ecsiface.ECSAPI, providing only the methods
+// collectECSProtectedDigests actually calls.
+type mockECS struct {
+	ecsiface.ECSAPI
+	clusterARNs []string
+	taskARNs    []string
+	tasks       []*ecs.Task
+}
+
+func (m *mockECS) ListClustersPages(input *ecs.ListClustersInput, fn func(*ecs.ListClustersOutput, bool) bool) error {
+	fn(&ecs.ListClustersOutput{ClusterArns: aws.StringSlice(m.clusterARNs)}, true)
+	return nil
+}
+
+func (m *mockECS) ListTasksPages(input *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool) error {
+	fn(&ecs.ListTasksOutput{TaskArns: aws.StringSlice(m.taskARNs)}, true)
+	return nil
+}
+
+func (m *mockECS) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	return &ecs.DescribeTasksOutput{Tasks: m.tasks}, nil
+}
+
+func TestCollectECSProtectedDigests(t *testing.T) {
+	mock := &mockECS{
+		clusterARNs: []string{"arn:aws:ecs:us-east-1:123:cluster/prod"},
+		taskARNs:    []string{"arn:aws:ecs:us-east-1:123:task/prod/abc"},
+		tasks: []*ecs.Task{
+			{
+				Containers: []*ecs.Container{
+					{
+						Image:       aws.String("123.dkr.ecr.us-east-1.amazonaws.com/my-repo:v1"),
+						ImageDigest: aws.String("sha256:abc"),
+					},
+				},
+			},
+		},
+	}
+
+	protected, err := collectECSProtectedDigests(mock)
+	if err != nil {
+		t.Fatalf("collectECSProtectedDigests: %v", err)
+	}
+
+	want := "my-repo@sha256:abc"
+	if !protected[want] {
+		t.Errorf("protected = %v, want it to contain %q", protected, want)
+	}
+}
+
+func TestLoadConfigFileRejectsInvalidRegex(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"repositories":[{"repo_glob":"*","exclude_regexes":["("]}]}`), 0644); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	if _, err := loadConfigFile(path); err == nil {
+		t.Fatal("expected an error for an invalid exclude_regexes pattern, got nil")
+	}
+}